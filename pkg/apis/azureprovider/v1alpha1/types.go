@@ -0,0 +1,95 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AzureClusterProviderSpec is the Schema for the azureclusterproviderspecs API.
+// +k8s:openapi-gen=true
+type AzureClusterProviderSpec struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ResourceGroup is the name of the Azure resource group that holds the
+	// resources for this cluster.
+	ResourceGroup string `json:"resourceGroup"`
+
+	// Location is the Azure region in which the cluster's resources are
+	// created.
+	Location string `json:"location"`
+
+	// NetworkSpec encapsulates all things related to Azure network.
+	NetworkSpec NetworkSpec `json:"networkSpec,omitempty"`
+
+	// CredentialsMode controls how the actuator obtains the Azure credentials
+	// it uses to reconcile resources. Passthrough uses the long-lived
+	// credentials found directly in CredentialsSecret, Mint requests
+	// short-lived, minimally-scoped credentials through a CredentialsRequest
+	// handled by the Cloud Credential Operator, and Manual expects an
+	// administrator to have populated CredentialsSecret out of band. Defaults
+	// to Passthrough when empty.
+	// +optional
+	CredentialsMode CredentialsMode `json:"credentialsMode,omitempty"`
+}
+
+// CredentialsMode describes how the actuator should obtain Azure credentials.
+type CredentialsMode string
+
+const (
+	// PassthroughCredentialsMode reads long-lived credentials directly out of
+	// the Secret referenced by CredentialsSecret.
+	PassthroughCredentialsMode CredentialsMode = "Passthrough"
+
+	// MintCredentialsMode has the actuator create a CredentialsRequest asking
+	// the Cloud Credential Operator to mint short-lived, minimally-scoped
+	// credentials into the Secret referenced by CredentialsSecret.
+	MintCredentialsMode CredentialsMode = "Mint"
+
+	// ManualCredentialsMode expects the Secret referenced by
+	// CredentialsSecret to already be populated by an administrator; the
+	// actuator neither mints nor validates its provenance.
+	ManualCredentialsMode CredentialsMode = "Manual"
+)
+
+// NetworkSpec specifies the configuration of the network for a cluster.
+type NetworkSpec struct {
+	// Vnet contains the virtual network information the cluster will run in.
+	Vnet VnetSpec `json:"vnet,omitempty"`
+}
+
+// VnetSpec configures an Azure virtual network.
+type VnetSpec struct {
+	// ResourceGroup is the resource group that the Vnet belongs to.
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+
+	// ID is the identifier of the Vnet.
+	ID string `json:"id,omitempty"`
+
+	// Name is the name of the Vnet.
+	Name string `json:"name,omitempty"`
+
+	// CidrBlock is the CIDR block to be used when the provider creates a
+	// managed Vnet.
+	CidrBlock string `json:"cidrBlock,omitempty"`
+}
+
+// AzureClusterProviderStatus contains the status fields
+// relevant to Azure for a cluster.
+type AzureClusterProviderStatus struct {
+	metav1.TypeMeta `json:",inline"`
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ProviderSpecFromRawExtension unmarshals a raw extension into an
+// AzureMachineProviderSpec type.
+func ProviderSpecFromRawExtension(rawExtension *runtime.RawExtension) (*AzureMachineProviderSpec, error) {
+	if rawExtension == nil {
+		return &AzureMachineProviderSpec{}, nil
+	}
+
+	spec := new(AzureMachineProviderSpec)
+	if err := yaml.Unmarshal(rawExtension.Raw, &spec); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// RawExtensionFromProviderSpec marshals an AzureMachineProviderSpec into a
+// raw extension type.
+func RawExtensionFromProviderSpec(spec *AzureMachineProviderSpec) (*runtime.RawExtension, error) {
+	if spec == nil {
+		return &runtime.RawExtension{}, nil
+	}
+
+	rawBytes, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: rawBytes}, nil
+}
+
+// MachineStatusFromProviderStatus unmarshals a raw extension into an
+// AzureMachineProviderStatus type.
+func MachineStatusFromProviderStatus(rawExtension *runtime.RawExtension) (*AzureMachineProviderStatus, error) {
+	if rawExtension == nil {
+		return &AzureMachineProviderStatus{}, nil
+	}
+
+	status := new(AzureMachineProviderStatus)
+	if err := yaml.Unmarshal(rawExtension.Raw, status); err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// RawExtensionFromProviderStatus marshals an AzureMachineProviderStatus into
+// a raw extension type.
+func RawExtensionFromProviderStatus(status *AzureMachineProviderStatus) (*runtime.RawExtension, error) {
+	if status == nil {
+		return &runtime.RawExtension{}, nil
+	}
+
+	rawBytes, err := yaml.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.RawExtension{Raw: rawBytes}, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionType is a valid value for Condition.Type, identifying one
+// operational aspect of a machine's Azure reconciliation.
+type ConditionType string
+
+const (
+	// CredentialsSecretValidCondition reports whether the Secret referenced
+	// by CredentialsSecret exists and carries its subscription ID and
+	// resource prefix keys. Missing authentication keys are reported on
+	// AzureAuthorizerReady, and missing location or resource group keys on
+	// ResourceGroupResolved.
+	CredentialsSecretValidCondition ConditionType = "CredentialsSecretValid"
+
+	// AzureAuthorizerReadyCondition reports whether an autorest.Authorizer
+	// was successfully built from the credentials Secret.
+	AzureAuthorizerReadyCondition ConditionType = "AzureAuthorizerReady"
+
+	// ResourceGroupResolvedCondition reports whether the machine's location
+	// and resource group were resolved, either from its own provider spec or
+	// from the credentials Secret.
+	ResourceGroupResolvedCondition ConditionType = "ResourceGroupResolved"
+)
+
+// Reasons set on the conditions above.
+const (
+	ReasonSecretNotFound        = "SecretNotFound"
+	ReasonMissingSubscriptionID = "MissingSubscriptionID"
+	ReasonMissingClientID       = "MissingClientID"
+	ReasonMissingClientSecret   = "MissingClientSecret"
+	ReasonMissingTenantID       = "MissingTenantID"
+	ReasonMissingResourceGroup  = "MissingResourceGroup"
+	ReasonLocationEmpty         = "LocationEmpty"
+	ReasonMissingResourcePrefix = "MissingResourcePrefix"
+	ReasonCredentialsInvalid    = "CredentialsInvalid"
+	ReasonValid                 = "Valid"
+	ReasonReady                 = "Ready"
+	ReasonResolved              = "Resolved"
+)
+
+// Condition defines an observation of one aspect of a machine's Azure
+// reconciliation, surfaced on the Machine so it can be inspected without
+// scraping controller logs.
+type Condition struct {
+	Type               ConditionType          `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// SetCondition returns conditions with conditionType set to status, updating
+// the matching entry in place (refreshing LastTransitionTime only when
+// Status actually changes) or appending a new entry otherwise.
+func SetCondition(conditions []Condition, conditionType ConditionType, status corev1.ConditionStatus, reason, message string) []Condition {
+	for i := range conditions {
+		if conditions[i].Type != conditionType {
+			continue
+		}
+		if conditions[i].Status != status {
+			conditions[i].LastTransitionTime = metav1.NewTime(time.Now())
+		}
+		conditions[i].Status = status
+		conditions[i].Reason = reason
+		conditions[i].Message = message
+		return conditions
+	}
+
+	return append(conditions, Condition{
+		Type:               conditionType,
+		Status:             status,
+		LastTransitionTime: metav1.NewTime(time.Now()),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// FindCondition returns the condition of the given type, or nil if conditions
+// has no such entry.
+func FindCondition(conditions []Condition, conditionType ConditionType) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AzureMachineProviderSpec is the Schema for the azuremachineproviderspecs API.
+// +k8s:openapi-gen=true
+type AzureMachineProviderSpec struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Location is the region in which the Azure resources for this machine
+	// will be created. Defaults to the value resolved from the
+	// CredentialsSecret when empty.
+	Location string `json:"location,omitempty"`
+
+	// ResourceGroup is the resource group in which the Azure resources for
+	// this machine will be created. Defaults to the value resolved from the
+	// CredentialsSecret when empty.
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+
+	// VMSize is the size of the VM to create.
+	VMSize string `json:"vmSize,omitempty"`
+
+	// Image is the image to use for the VM.
+	Image Image `json:"image,omitempty"`
+
+	// CredentialsSecret is a reference to the secret with Azure credentials.
+	CredentialsSecret *corev1.SecretReference `json:"credentialsSecret,omitempty"`
+}
+
+// Image is the Azure image to use for creating the VM.
+type Image struct {
+	// Publisher is the publisher of the image.
+	Publisher string `json:"publisher,omitempty"`
+
+	// Offer is the offer of the image.
+	Offer string `json:"offer,omitempty"`
+
+	// SKU is the SKU of the image.
+	SKU string `json:"sku,omitempty"`
+
+	// Version is the version of the image.
+	Version string `json:"version,omitempty"`
+
+	// ResourceID is the ID of a custom image to use for the VM.
+	ResourceID string `json:"resourceID,omitempty"`
+}
+
+// AzureMachineProviderStatus is the Schema for the azuremachineproviderstatuses API.
+// +k8s:openapi-gen=true
+type AzureMachineProviderStatus struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// VMID is the ID of the VM in Azure.
+	VMID *string `json:"vmId,omitempty"`
+
+	// VMState is the provisioning state of the Azure VM.
+	VMState *VMState `json:"vmState,omitempty"`
+
+	// InstanceState is the lifecycle state of the instance, derived from the
+	// VM's ARM ProvisioningState and PowerState (e.g. Creating, Running,
+	// Stopping, Deallocated, Failed).
+	InstanceState *string `json:"instanceState,omitempty"`
+
+	// LastInstanceStateTransitionTime is the last time InstanceState changed.
+	LastInstanceStateTransitionTime *metav1.Time `json:"lastInstanceStateTransitionTime,omitempty"`
+
+	// FailureReason reports a machine-readable cause when InstanceState has
+	// settled in a terminal failure.
+	FailureReason *string `json:"failureReason,omitempty"`
+
+	// FailureMessage reports a human-readable cause when InstanceState has
+	// settled in a terminal failure.
+	FailureMessage *string `json:"failureMessage,omitempty"`
+
+	// Conditions is a set of conditions associated with the machine to
+	// indicate errors or other status, surfaced by MachineScope.Persist and
+	// MachineScope.PersistConditions.
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// VMState describes the state of an Azure virtual machine.
+type VMState string
+
+// Instance lifecycle states recorded in AzureMachineProviderStatus.InstanceState,
+// derived from the VM's ARM ProvisioningState and PowerState. Mirrors the
+// InstanceState field added to the GCP provider's equivalent status type.
+const (
+	InstanceStateCreating    = "Creating"
+	InstanceStateRunning     = "Running"
+	InstanceStateStopping    = "Stopping"
+	InstanceStateDeallocated = "Deallocated"
+	InstanceStateFailed      = "Failed"
+)
+
+// IsTerminalFailureState reports whether status's InstanceState is a known
+// terminal failure, i.e. one an administrator must resolve by fixing the
+// machine's spec or deleting it; reconciling it further by calling the ARM
+// API again cannot help.
+func IsTerminalFailureState(status *AzureMachineProviderStatus) bool {
+	return status != nil && status.InstanceState != nil && *status.InstanceState == InstanceStateFailed
+}
@@ -0,0 +1,725 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package actuators
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/go-multierror"
+	clusterv1 "github.com/openshift/cluster-api/pkg/apis/cluster/v1alpha1"
+	machinev1 "github.com/openshift/cluster-api/pkg/apis/machine/v1beta1"
+	machineclientv1 "github.com/openshift/cluster-api/pkg/client/clientset_generated/clientset/typed/machine/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/cluster-api-provider-azure/pkg/apis/azureprovider/v1alpha1"
+	machinev1beta1 "sigs.k8s.io/cluster-api-provider-azure/pkg/apis/azureprovider/v1beta1"
+	controllerclient "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// credentialsRequestPollInterval and credentialsRequestPollTimeout bound how
+// long NewMachineScope waits for the Cloud Credential Operator to resolve a
+// CredentialsRequest into a Secret when CredentialsMode is Mint.
+const (
+	credentialsRequestPollInterval = 3 * time.Second
+	credentialsRequestPollTimeout  = 2 * time.Minute
+)
+
+// AzureClients contains all the Azure clients used by the actuators.
+type AzureClients struct {
+	SubscriptionID string
+	Authorizer     autorest.Authorizer
+}
+
+// Scope contains the core data each of the provider's actuators needs to
+// reconcile an Azure cluster or machine.
+type Scope struct {
+	AzureClients
+
+	Cluster       *clusterv1.Cluster
+	ClusterConfig *v1alpha1.AzureClusterProviderSpec
+	ClusterStatus *v1alpha1.AzureClusterProviderStatus
+}
+
+// Location returns the Azure region the scope's resources are reconciled in.
+func (s *Scope) Location() string {
+	return s.ClusterConfig.Location
+}
+
+// MachineScopeParams defines the input parameters used to create a new
+// MachineScope.
+type MachineScopeParams struct {
+	AzureClients
+
+	Cluster       *clusterv1.Cluster
+	CoreClient    controllerclient.Client
+	Machine       *machinev1.Machine
+	Client        machineclientv1.MachineV1beta1Interface
+	EventRecorder record.EventRecorder
+
+	// CredentialsMode controls how the machine's credentials are obtained.
+	// Defaults to PassthroughCredentialsMode when empty; AzureMachineProviderSpec
+	// has no CredentialsMode of its own to fall back to.
+	CredentialsMode v1alpha1.CredentialsMode
+}
+
+// MachineScope defines a scope defined around a machine and its cluster.
+type MachineScope struct {
+	Scope
+
+	Machine       *machinev1.Machine
+	MachineClient machineclientv1.MachineV1beta1Interface
+	MachineConfig *machinev1beta1.AzureMachineProviderSpec
+	MachineStatus *machinev1beta1.AzureMachineProviderStatus
+	EventRecorder record.EventRecorder
+
+	// origInstanceState is the InstanceState read back from the API server
+	// when the scope was created, kept so Persist can tell whether it
+	// changed and is worth an Event.
+	origInstanceState *string
+}
+
+// NewMachineScope creates a new MachineScope from the supplied parameters.
+// This is meant to be called for each machine actuator operation.
+func NewMachineScope(params MachineScopeParams) (*MachineScope, error) {
+	machineConfig, err := machinev1beta1.ProviderSpecFromRawExtension(params.Machine.Spec.ProviderSpec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode provider spec for machine %q: %v", params.Machine.Name, err)
+	}
+
+	machineStatus, err := machinev1beta1.MachineStatusFromProviderStatus(params.Machine.Status.ProviderStatus)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode provider status for machine %q: %v", params.Machine.Name, err)
+	}
+
+	credentialsMode := params.CredentialsMode
+	if credentialsMode == "" {
+		credentialsMode = v1alpha1.PassthroughCredentialsMode
+	}
+
+	scope := Scope{
+		AzureClients: params.AzureClients,
+		Cluster:      params.Cluster,
+		ClusterConfig: &v1alpha1.AzureClusterProviderSpec{
+			Location:        machineConfig.Location,
+			ResourceGroup:   machineConfig.ResourceGroup,
+			CredentialsMode: credentialsMode,
+		},
+	}
+	if scope.Cluster == nil {
+		scope.Cluster = &clusterv1.Cluster{}
+	}
+
+	machineScope := &MachineScope{
+		Scope:             scope,
+		Machine:           params.Machine,
+		MachineClient:     params.Client,
+		MachineConfig:     machineConfig,
+		MachineStatus:     machineStatus,
+		EventRecorder:     params.EventRecorder,
+		origInstanceState: machineStatus.InstanceState,
+	}
+
+	if machineConfig.CredentialsSecret == nil {
+		return machineScope, nil
+	}
+
+	secretRef := machineConfig.CredentialsSecret
+	if credentialsMode == v1alpha1.MintCredentialsMode {
+		if secretRef, err = reconcileCredentialsRequest(params.CoreClient, params.Machine, secretRef); err != nil {
+			machineScope.recordCredentialFailure(err)
+			if persistErr := machineScope.PersistConditions(); persistErr != nil {
+				return nil, fmt.Errorf("failed to reconcile CredentialsRequest for machine %q: %v (and failed to persist conditions: %v)", params.Machine.Name, err, persistErr)
+			}
+			return nil, fmt.Errorf("failed to reconcile CredentialsRequest for machine %q: %v", params.Machine.Name, err)
+		}
+	}
+
+	if err := updateScope(params.CoreClient, secretRef, &machineScope.Scope); err != nil {
+		machineScope.recordCredentialFailure(err)
+		if persistErr := machineScope.PersistConditions(); persistErr != nil {
+			return nil, fmt.Errorf("failed to update scope for machine %q: %v (and failed to persist conditions: %v)", params.Machine.Name, err, persistErr)
+		}
+		return nil, fmt.Errorf("failed to update scope for machine %q: %v", params.Machine.Name, err)
+	}
+
+	machineScope.recordCredentialSuccess()
+	if err := machineScope.PersistConditions(); err != nil {
+		return nil, fmt.Errorf("failed to persist conditions for machine %q: %v", params.Machine.Name, err)
+	}
+
+	return machineScope, nil
+}
+
+// recordCredentialSuccess marks every credential-related condition True.
+func (m *MachineScope) recordCredentialSuccess() {
+	m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.CredentialsSecretValidCondition, corev1.ConditionTrue, machinev1beta1.ReasonValid, "credentials secret contains all fields required by its authentication mode")
+	m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.AzureAuthorizerReadyCondition, corev1.ConditionTrue, machinev1beta1.ReasonReady, "azure authorizer constructed from credentials secret")
+	m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.ResourceGroupResolvedCondition, corev1.ConditionTrue, machinev1beta1.ReasonResolved, "location and resource group resolved")
+}
+
+// recordCredentialFailure marks the credential-related conditions affected
+// by err False, with a machine-readable Reason derived from it, so a user can
+// tell why a machine is stuck without scraping controller logs.
+func (m *MachineScope) recordCredentialFailure(err error) {
+	message := err.Error()
+
+	if !errors.Is(err, ErrMissingCredentialField) {
+		// The secret itself couldn't be read (not found, reconciling its
+		// CredentialsRequest failed, etc): nothing derived from it is known.
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.CredentialsSecretValidCondition, corev1.ConditionFalse, machinev1beta1.ReasonSecretNotFound, message)
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.AzureAuthorizerReadyCondition, corev1.ConditionFalse, machinev1beta1.ReasonSecretNotFound, message)
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.ResourceGroupResolvedCondition, corev1.ConditionFalse, machinev1beta1.ReasonSecretNotFound, message)
+		return
+	}
+
+	credentialsValid := !strings.Contains(message, azureSubscriptionIDKey) && !strings.Contains(message, azureResourcePrefixKey)
+	authorizerReady := !strings.Contains(message, azureClientIDKey) && !strings.Contains(message, azureClientSecretKey) && !strings.Contains(message, azureTenantIDKey)
+	resourceGroupResolved := !strings.Contains(message, azureResourceGroupKey) && !strings.Contains(message, azureRegionKey)
+
+	if credentialsValid {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.CredentialsSecretValidCondition, corev1.ConditionTrue, machinev1beta1.ReasonValid, "credentials secret contains the required subscription and cluster name fields")
+	} else {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.CredentialsSecretValidCondition, corev1.ConditionFalse, credentialValidationReason(message, credentialsSecretValidReasons), message)
+	}
+
+	if authorizerReady {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.AzureAuthorizerReadyCondition, corev1.ConditionTrue, machinev1beta1.ReasonReady, "azure authorizer constructed from credentials secret")
+	} else {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.AzureAuthorizerReadyCondition, corev1.ConditionFalse, credentialValidationReason(message, azureAuthorizerReadyReasons), message)
+	}
+
+	if resourceGroupResolved {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.ResourceGroupResolvedCondition, corev1.ConditionTrue, machinev1beta1.ReasonResolved, "location and resource group resolved")
+	} else {
+		m.MachineStatus.Conditions = machinev1beta1.SetCondition(m.MachineStatus.Conditions, machinev1beta1.ResourceGroupResolvedCondition, corev1.ConditionFalse, credentialValidationReason(message, resourceGroupResolvedReasons), message)
+	}
+}
+
+// keyReason pairs a credentials Secret key with the Reason to report when
+// that key is the one missing.
+type keyReason struct {
+	key    string
+	reason string
+}
+
+// credentialsSecretValidReasons, azureAuthorizerReadyReasons and
+// resourceGroupResolvedReasons list, in priority order, only the keys each
+// condition actually depends on. Keeping these separate (rather than one
+// global priority order shared by every condition) matters whenever more
+// than one field is missing at once: a condition must be blamed for its own
+// missing key, not for whichever key happens to rank first across all three.
+var (
+	credentialsSecretValidReasons = []keyReason{
+		{azureSubscriptionIDKey, machinev1beta1.ReasonMissingSubscriptionID},
+		{azureResourcePrefixKey, machinev1beta1.ReasonMissingResourcePrefix},
+	}
+	azureAuthorizerReadyReasons = []keyReason{
+		{azureClientIDKey, machinev1beta1.ReasonMissingClientID},
+		{azureClientSecretKey, machinev1beta1.ReasonMissingClientSecret},
+		{azureTenantIDKey, machinev1beta1.ReasonMissingTenantID},
+	}
+	resourceGroupResolvedReasons = []keyReason{
+		{azureResourceGroupKey, machinev1beta1.ReasonMissingResourceGroup},
+		{azureRegionKey, machinev1beta1.ReasonLocationEmpty},
+	}
+)
+
+// credentialValidationReason picks the most relevant machine-readable reason
+// out of a (possibly aggregated) validation error message, considering only
+// the keys in reasons.
+func credentialValidationReason(message string, reasons []keyReason) string {
+	for _, r := range reasons {
+		if strings.Contains(message, r.key) {
+			return r.reason
+		}
+	}
+	return machinev1beta1.ReasonCredentialsInvalid
+}
+
+// Keys read out of the credentials Secret referenced by a machine or
+// cluster's CredentialsSecret. Which of these are required depends on the
+// authentication mode the Secret selects; see authorizerFromSecret.
+const (
+	azureSubscriptionIDKey     = "azure_subscription_id"
+	azureClientIDKey           = "azure_client_id"
+	azureClientSecretKey       = "azure_client_secret"
+	azureTenantIDKey           = "azure_tenant_id"
+	azureResourceGroupKey      = "azure_resourcegroup"
+	azureRegionKey             = "azure_region"
+	azureResourcePrefixKey     = "azure_resource_prefix"
+	azureUseMSIKey             = "azure_use_msi"
+	azureMSIClientIDKey        = "azure_msi_client_id"
+	azureFederatedTokenFileKey = "azure_federated_token_file"
+)
+
+// ErrMissingCredentialField is wrapped by every error updateScope returns on
+// account of a required key being absent or empty in the credentials
+// Secret. Callers that only care whether validation failed for this reason,
+// as opposed to e.g. a transient API error, can check with errors.Is rather
+// than parsing the (possibly aggregated) message.
+var ErrMissingCredentialField = errors.New("missing required credentials field")
+
+// missingFieldError builds an error for a single absent/empty key, wrapping
+// ErrMissingCredentialField so it can be identified with errors.Is.
+func missingFieldError(key string) error {
+	return fmt.Errorf("%w: %s", ErrMissingCredentialField, key)
+}
+
+// updateScope populates scope with the subscription, cluster name, location
+// and resource group found in the Secret referenced by secretRef, and builds
+// the Authorizer the actuators use to talk to Azure. Location and
+// ResourceGroup already set on scope.ClusterConfig (e.g. from the machine's
+// own provider spec) take precedence over the Secret's values. Every
+// required key that is missing or empty is collected into the returned
+// error, rather than stopping at the first one, so a user fixing a broken
+// Secret sees every problem in a single reconcile.
+func updateScope(coreClient controllerclient.Client, secretRef *corev1.SecretReference, scope *Scope) error {
+	if coreClient == nil {
+		return fmt.Errorf("no client available to read credentials secret %q", secretRef.Name)
+	}
+
+	secret := &corev1.Secret{}
+	key := controllerclient.ObjectKey{Namespace: secretRef.Namespace, Name: secretRef.Name}
+	if err := coreClient.Get(context.Background(), key, secret); err != nil {
+		return fmt.Errorf("failed to get credentials secret %q in namespace %q: %v", secretRef.Name, secretRef.Namespace, err)
+	}
+
+	var result *multierror.Error
+
+	if subscriptionID, ok := secret.Data[azureSubscriptionIDKey]; ok && len(subscriptionID) > 0 {
+		scope.SubscriptionID = string(subscriptionID)
+	} else {
+		result = multierror.Append(result, missingFieldError(azureSubscriptionIDKey))
+	}
+
+	if scope.ClusterConfig.ResourceGroup == "" {
+		if resourceGroup, ok := secret.Data[azureResourceGroupKey]; ok && len(resourceGroup) > 0 {
+			scope.ClusterConfig.ResourceGroup = string(resourceGroup)
+		} else {
+			result = multierror.Append(result, missingFieldError(azureResourceGroupKey))
+		}
+	}
+
+	if scope.ClusterConfig.Location == "" {
+		if region, ok := secret.Data[azureRegionKey]; ok && len(region) > 0 {
+			scope.ClusterConfig.Location = string(region)
+		} else {
+			result = multierror.Append(result, missingFieldError(azureRegionKey))
+		}
+	}
+
+	if resourcePrefix, ok := secret.Data[azureResourcePrefixKey]; ok && len(resourcePrefix) > 0 {
+		scope.Cluster.Name = string(resourcePrefix)
+	} else {
+		result = multierror.Append(result, missingFieldError(azureResourcePrefixKey))
+	}
+
+	authorizer, err := authorizerFromSecret(secret)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+
+	if err := result.ErrorOrNil(); err != nil {
+		return fmt.Errorf("credentials secret %q: %w", secretRef.Name, err)
+	}
+
+	scope.Authorizer = authorizer
+
+	return nil
+}
+
+// authorizerFromSecret builds the autorest.Authorizer the actuators use to
+// talk to Azure from whichever authentication mode secret selects:
+//   - azure_use_msi=true selects Managed Identity, system-assigned unless
+//     azure_msi_client_id names a user-assigned identity.
+//   - azure_federated_token_file selects Workload Identity / AAD Pod
+//     Identity, exchanging the projected service account token named by that
+//     file for an Azure AD token on behalf of azure_client_id.
+//   - otherwise the long-lived azure_client_id/azure_client_secret pair is
+//     used directly (Passthrough).
+func authorizerFromSecret(secret *corev1.Secret) (autorest.Authorizer, error) {
+	if useMSI, _ := strconv.ParseBool(string(secret.Data[azureUseMSIKey])); useMSI {
+		return msiAuthorizer(secret)
+	}
+
+	if tokenFile := secret.Data[azureFederatedTokenFileKey]; len(tokenFile) > 0 {
+		return workloadIdentityAuthorizer(secret, string(tokenFile))
+	}
+
+	return passthroughAuthorizer(secret)
+}
+
+// passthroughAuthorizer builds an Authorizer from a long-lived service
+// principal client ID/secret pair.
+func passthroughAuthorizer(secret *corev1.Secret) (autorest.Authorizer, error) {
+	var result *multierror.Error
+
+	clientID, ok := secret.Data[azureClientIDKey]
+	if !ok || len(clientID) == 0 {
+		result = multierror.Append(result, missingFieldError(azureClientIDKey))
+	}
+
+	clientSecret, ok := secret.Data[azureClientSecretKey]
+	if !ok || len(clientSecret) == 0 {
+		result = multierror.Append(result, missingFieldError(azureClientSecretKey))
+	}
+
+	tenantID, ok := secret.Data[azureTenantIDKey]
+	if !ok || len(tenantID) == 0 {
+		result = multierror.Append(result, missingFieldError(azureTenantIDKey))
+	}
+
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, string(tenantID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OAuth config: %v", err)
+	}
+
+	token, err := adal.NewServicePrincipalToken(*oauthConfig, string(clientID), string(clientSecret), azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service principal token: %v", err)
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// msiAuthorizer builds an Authorizer from the Azure Instance Metadata
+// Service, using the system-assigned identity unless azure_msi_client_id
+// names a user-assigned one.
+func msiAuthorizer(secret *corev1.Secret) (autorest.Authorizer, error) {
+	msiEndpoint, err := adal.GetMSIVMEndpoint()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve MSI endpoint: %v", err)
+	}
+
+	msiClientID := string(secret.Data[azureMSIClientIDKey])
+
+	var token *adal.ServicePrincipalToken
+	if msiClientID != "" {
+		token, err = adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(msiEndpoint, azure.PublicCloud.ResourceManagerEndpoint, msiClientID)
+	} else {
+		token, err = adal.NewServicePrincipalTokenFromMSI(msiEndpoint, azure.PublicCloud.ResourceManagerEndpoint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MSI token: %v", err)
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// workloadIdentityAuthorizer builds an Authorizer by exchanging the
+// projected service account token at tokenFile for an Azure AD token, on
+// behalf of the azure_client_id app registration federated with that token's
+// issuer (Workload Identity / AAD Pod Identity).
+func workloadIdentityAuthorizer(secret *corev1.Secret, tokenFile string) (autorest.Authorizer, error) {
+	var result *multierror.Error
+
+	clientID, ok := secret.Data[azureClientIDKey]
+	if !ok || len(clientID) == 0 {
+		result = multierror.Append(result, missingFieldError(azureClientIDKey))
+	}
+
+	tenantID, ok := secret.Data[azureTenantIDKey]
+	if !ok || len(tenantID) == 0 {
+		result = multierror.Append(result, missingFieldError(azureTenantIDKey))
+	}
+
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+
+	jwt, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", azureFederatedTokenFileKey, err)
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, string(tenantID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OAuth config: %v", err)
+	}
+
+	token, err := adal.NewServicePrincipalTokenFromFederatedToken(*oauthConfig, string(clientID), string(jwt), azure.PublicCloud.ResourceManagerEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create federated token: %v", err)
+	}
+
+	return autorest.NewBearerAuthorizer(token), nil
+}
+
+// Persist writes the machine and its provider status back to the API server,
+// first recording any change of MachineStatus.InstanceState since the scope
+// was created as described on recordInstanceStateTransition.
+func (m *MachineScope) Persist() error {
+	m.recordInstanceStateTransition()
+
+	if err := m.PersistConditions(); err != nil {
+		return err
+	}
+
+	if m.MachineClient == nil {
+		return nil
+	}
+
+	if _, err := m.MachineClient.Machines(m.Machine.Namespace).Update(m.Machine); err != nil {
+		return fmt.Errorf("failed to update machine %q: %v", m.Machine.Name, err)
+	}
+
+	return nil
+}
+
+// recordInstanceStateTransition sets LastInstanceStateTransitionTime and
+// emits a Normal Event named "InstanceState<state>" when MachineStatus's
+// InstanceState differs from the value the scope was created with. The first
+// time InstanceState is populated from empty it only sets
+// LastInstanceStateTransitionTime and emits no Event, since that is discovery
+// rather than a transition. Clearing InstanceState back to nil does nothing.
+func (m *MachineScope) recordInstanceStateTransition() {
+	oldState := m.origInstanceState
+	newState := m.MachineStatus.InstanceState
+
+	if (oldState == nil && newState == nil) || (oldState != nil && newState != nil && *oldState == *newState) {
+		return
+	}
+	if newState == nil {
+		return
+	}
+
+	now := metav1.NewTime(time.Now())
+	m.MachineStatus.LastInstanceStateTransitionTime = &now
+
+	if oldState == nil {
+		return
+	}
+
+	if m.EventRecorder != nil {
+		m.EventRecorder.Eventf(m.Machine, corev1.EventTypeNormal, "InstanceState"+*newState, "Machine %q instance state changed from %q to %q", m.Machine.Name, *oldState, *newState)
+	}
+}
+
+// PersistConditions writes the machine's provider status, including
+// MachineStatus.Conditions, back to the API server without touching the rest
+// of the Machine object. This lets NewMachineScope surface why it failed
+// (e.g. CredentialsSecretValid=False, Reason=MissingClientID) even when it
+// has no fully-populated MachineScope to hand back to its caller.
+func (m *MachineScope) PersistConditions() error {
+	ext, err := machinev1beta1.RawExtensionFromProviderStatus(m.MachineStatus)
+	if err != nil {
+		return fmt.Errorf("failed to encode provider status for machine %q: %v", m.Machine.Name, err)
+	}
+	m.Machine.Status.ProviderStatus = ext
+
+	if m.MachineClient == nil {
+		return nil
+	}
+
+	if _, err := m.MachineClient.Machines(m.Machine.Namespace).UpdateStatus(m.Machine); err != nil {
+		return fmt.Errorf("failed to update status for machine %q: %v", m.Machine.Name, err)
+	}
+
+	return nil
+}
+
+// IsTerminalFailureState reports whether the machine's InstanceState is a
+// known terminal failure. Once InstanceState settles in a terminal failure,
+// retrying the same ARM operation cannot help and only churns the API, so
+// the actuator's reconcile entry point should check this before calling out
+// to ARM again and short-circuit if it's true.
+//
+// NOTE: this package only builds and persists MachineScope; the actuator's
+// Create/Update reconcile loop that would call IsTerminalFailureState is not
+// part of this package and is out of scope here.
+func (m *MachineScope) IsTerminalFailureState() bool {
+	return machinev1beta1.IsTerminalFailureState(m.MachineStatus)
+}
+
+// credentialsRequestNamespace is the namespace the Cloud Credential Operator
+// watches for CredentialsRequest objects.
+const credentialsRequestNamespace = "openshift-cloud-credential-operator"
+
+// azureActuatorPermissions are the minimal Azure role actions the actuator
+// calls while reconciling a machine: creating, updating and deleting the VM
+// and its network interface and public IP.
+var azureActuatorPermissions = []string{
+	"Microsoft.Compute/virtualMachines/read",
+	"Microsoft.Compute/virtualMachines/write",
+	"Microsoft.Compute/virtualMachines/delete",
+	"Microsoft.Network/networkInterfaces/read",
+	"Microsoft.Network/networkInterfaces/write",
+	"Microsoft.Network/networkInterfaces/delete",
+	"Microsoft.Network/publicIPAddresses/read",
+	"Microsoft.Network/publicIPAddresses/write",
+	"Microsoft.Network/publicIPAddresses/delete",
+}
+
+// azureProviderSpecKind is the Kind CCO expects stamped onto an
+// AzureProviderSpec embedded in a CredentialsRequest.
+const azureProviderSpecKind = "AzureProviderSpec"
+
+// azureProviderSpec mirrors cloudcredential.openshift.io/v1's AzureProviderSpec,
+// the Azure-specific portion of a CredentialsRequest's ProviderSpec.
+type azureProviderSpec struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// RoleBindings lists the Azure roles CCO should grant the minted service
+	// principal.
+	RoleBindings []azureRoleBinding `json:"roleBindings,omitempty"`
+
+	// Permissions lists the raw Azure role actions CCO should grant the
+	// minted service principal via a custom role definition.
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// azureRoleBinding names a single Azure role to bind to the minted service
+// principal.
+type azureRoleBinding struct {
+	Role string `json:"role"`
+}
+
+// credentialsRequest is a minimal local stand-in for the Cloud Credential
+// Operator's CredentialsRequest CRD, covering only the fields the actuator
+// needs to set or read.
+type credentialsRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec credentialsRequestSpec `json:"spec,omitempty"`
+}
+
+type credentialsRequestSpec struct {
+	SecretRef    corev1.ObjectReference `json:"secretRef"`
+	ProviderSpec *azureProviderSpec     `json:"providerSpec,omitempty"`
+}
+
+// DeepCopyObject implements runtime.Object so credentialsRequest can be used
+// with a controller-runtime client.
+func (c *credentialsRequest) DeepCopyObject() runtime.Object {
+	out := *c
+	out.ObjectMeta = *c.ObjectMeta.DeepCopy()
+	if c.Spec.ProviderSpec != nil {
+		providerSpec := *c.Spec.ProviderSpec
+		providerSpec.RoleBindings = append([]azureRoleBinding(nil), c.Spec.ProviderSpec.RoleBindings...)
+		providerSpec.Permissions = append([]string(nil), c.Spec.ProviderSpec.Permissions...)
+		out.Spec.ProviderSpec = &providerSpec
+	}
+	return &out
+}
+
+// credentialsRequestGroupVersion and credentialsRequestKind are the real
+// Cloud Credential Operator CredentialsRequest CRD's GroupVersionKind. desired
+// is stamped with them below so CCO recognizes and reconciles the objects
+// this actuator creates, rather than an empty GVK it would never pick up.
+var credentialsRequestGroupVersion = schema.GroupVersion{Group: "cloudcredential.openshift.io", Version: "v1"}
+
+const credentialsRequestKind = "CredentialsRequest"
+
+// credentialsRequestSchemeBuilder registers credentialsRequest's
+// GroupVersionKind into a runtime.Scheme.
+var credentialsRequestSchemeBuilder = runtime.NewSchemeBuilder(func(s *runtime.Scheme) error {
+	s.AddKnownTypes(credentialsRequestGroupVersion, &credentialsRequest{})
+	return nil
+})
+
+// AddToScheme registers the CredentialsRequest type this actuator reconciles
+// with scheme. Whatever builds the manager's CoreClient must call this once
+// at startup, the same way every other API group a cluster-api manager
+// serves is registered, or Get/Create/Update against a CredentialsRequest
+// will fail with "no kind is registered for the type".
+var AddToScheme = credentialsRequestSchemeBuilder.AddToScheme
+
+// reconcileCredentialsRequest creates or updates the CredentialsRequest that
+// asks the Cloud Credential Operator to mint a scoped service principal into
+// targetSecretRef, then waits for CCO to write that Secret before returning.
+func reconcileCredentialsRequest(coreClient controllerclient.Client, machine *machinev1.Machine, targetSecretRef *corev1.SecretReference) (*corev1.SecretReference, error) {
+	if coreClient == nil {
+		return nil, fmt.Errorf("no client available to reconcile CredentialsRequest")
+	}
+
+	name := fmt.Sprintf("%s-azure-machine-api", machine.Name)
+	desired := &credentialsRequest{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: credentialsRequestGroupVersion.String(),
+			Kind:       credentialsRequestKind,
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: credentialsRequestNamespace,
+		},
+		Spec: credentialsRequestSpec{
+			SecretRef: corev1.ObjectReference{
+				Name:      targetSecretRef.Name,
+				Namespace: targetSecretRef.Namespace,
+			},
+			ProviderSpec: &azureProviderSpec{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: credentialsRequestGroupVersion.String(),
+					Kind:       azureProviderSpecKind,
+				},
+				Permissions: azureActuatorPermissions,
+			},
+		},
+	}
+
+	existing := &credentialsRequest{}
+	key := controllerclient.ObjectKey{Name: name, Namespace: credentialsRequestNamespace}
+	switch err := coreClient.Get(context.Background(), key, existing); {
+	case apierrors.IsNotFound(err):
+		if err := coreClient.Create(context.Background(), desired); err != nil {
+			return nil, fmt.Errorf("failed to create CredentialsRequest %q: %v", name, err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to get CredentialsRequest %q: %v", name, err)
+	default:
+		existing.Spec = desired.Spec
+		if err := coreClient.Update(context.Background(), existing); err != nil {
+			return nil, fmt.Errorf("failed to update CredentialsRequest %q: %v", name, err)
+		}
+	}
+
+	resolvedSecret := &corev1.Secret{}
+	secretKey := controllerclient.ObjectKey{Name: targetSecretRef.Name, Namespace: targetSecretRef.Namespace}
+	err := wait.PollImmediate(credentialsRequestPollInterval, credentialsRequestPollTimeout, func() (bool, error) {
+		if err := coreClient.Get(context.Background(), secretKey, resolvedSecret); err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("timed out waiting for CredentialsRequest %q to resolve secret %q: %v", name, targetSecretRef.Name, err)
+	}
+
+	return targetSecretRef, nil
+}
@@ -17,6 +17,12 @@ limitations under the License.
 package actuators
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ghodss/yaml"
@@ -28,9 +34,11 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/pointer"
 	clusterproviderv1 "sigs.k8s.io/cluster-api-provider-azure/pkg/apis/azureprovider/v1alpha1"
 	machineproviderv1 "sigs.k8s.io/cluster-api-provider-azure/pkg/apis/azureprovider/v1beta1"
+	controllerclient "sigs.k8s.io/controller-runtime/pkg/client"
 	controllerfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
@@ -75,6 +83,37 @@ func TestNilClusterScope(t *testing.T) {
 	}
 }
 
+func TestReconcileCredentialsRequest(t *testing.T) {
+	if err := AddToScheme(scheme.Scheme); err != nil {
+		t.Fatalf("failed to register CredentialsRequest with the scheme: %v", err)
+	}
+
+	machine := testMachine(t)
+	secretRef := &corev1.SecretReference{Name: "testCredentials", Namespace: "dummyNamespace"}
+	coreClient := controllerfake.NewFakeClientWithScheme(scheme.Scheme, testCredentialSecret())
+
+	got, err := reconcileCredentialsRequest(coreClient, machine, secretRef)
+	if err != nil {
+		t.Fatalf("Expected reconcileCredentialsRequest to succeed: %v", err)
+	}
+	if got != secretRef {
+		t.Errorf("Expected the target secret reference to be returned unchanged")
+	}
+
+	created := &credentialsRequest{}
+	name := fmt.Sprintf("%s-azure-machine-api", machine.Name)
+	key := controllerclient.ObjectKey{Name: name, Namespace: credentialsRequestNamespace}
+	if err := coreClient.Get(context.Background(), key, created); err != nil {
+		t.Fatalf("Expected a CredentialsRequest to have been created: %v", err)
+	}
+	if created.APIVersion != credentialsRequestGroupVersion.String() || created.Kind != credentialsRequestKind {
+		t.Errorf("Expected CredentialsRequest to carry the Cloud Credential Operator GroupVersionKind, got %s/%s", created.APIVersion, created.Kind)
+	}
+	if created.Spec.SecretRef.Name != secretRef.Name || created.Spec.SecretRef.Namespace != secretRef.Namespace {
+		t.Errorf("Expected CredentialsRequest to target secret %q/%q, got %q/%q", secretRef.Namespace, secretRef.Name, created.Spec.SecretRef.Namespace, created.Spec.SecretRef.Name)
+	}
+}
+
 func TestCredentialsSecretSuccess(t *testing.T) {
 	credentialsSecret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
@@ -117,6 +156,124 @@ func TestCredentialsSecretSuccess(t *testing.T) {
 	}
 }
 
+func TestCredentialsSecretSuccessMSI(t *testing.T) {
+	credentialsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testCredentials",
+			Namespace: "dummyNamespace",
+		},
+		Data: map[string][]byte{
+			"azure_subscription_id": []byte("dummySubID"),
+			"azure_resourcegroup":   []byte("dummyResourceGroup"),
+			"azure_region":          []byte("dummyRegion"),
+			"azure_resource_prefix": []byte("dummyClusterName"),
+			"azure_use_msi":         []byte("true"),
+		},
+	}
+	scope := &Scope{Cluster: &clusterv1.Cluster{}, ClusterConfig: &clusterproviderv1.AzureClusterProviderSpec{}}
+	err := updateScope(
+		controllerfake.NewFakeClient(credentialsSecret),
+		&corev1.SecretReference{Name: "testCredentials", Namespace: "dummyNamespace"},
+		scope)
+	if err != nil {
+		t.Fatalf("Expected system-assigned MSI credentials secret to succeed: %v", err)
+	}
+	if scope.Authorizer == nil {
+		t.Errorf("Expected an Authorizer to be set")
+	}
+
+	credentialsSecret.Data["azure_msi_client_id"] = []byte("dummyUserAssignedClientID")
+	scope = &Scope{Cluster: &clusterv1.Cluster{}, ClusterConfig: &clusterproviderv1.AzureClusterProviderSpec{}}
+	err = updateScope(
+		controllerfake.NewFakeClient(credentialsSecret),
+		&corev1.SecretReference{Name: "testCredentials", Namespace: "dummyNamespace"},
+		scope)
+	if err != nil {
+		t.Fatalf("Expected user-assigned MSI credentials secret to succeed: %v", err)
+	}
+	if scope.Authorizer == nil {
+		t.Errorf("Expected an Authorizer to be set")
+	}
+}
+
+func TestCredentialsSecretSuccessWorkloadIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("dummyFederatedToken"), 0o600); err != nil {
+		t.Fatalf("failed to write federated token file: %v", err)
+	}
+
+	credentialsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testCredentials",
+			Namespace: "dummyNamespace",
+		},
+		Data: map[string][]byte{
+			"azure_subscription_id":      []byte("dummySubID"),
+			"azure_resourcegroup":        []byte("dummyResourceGroup"),
+			"azure_region":               []byte("dummyRegion"),
+			"azure_resource_prefix":      []byte("dummyClusterName"),
+			"azure_client_id":            []byte("dummyClientID"),
+			"azure_tenant_id":            []byte("dummyTenantID"),
+			"azure_federated_token_file": []byte(tokenFile),
+		},
+	}
+	scope := &Scope{Cluster: &clusterv1.Cluster{}, ClusterConfig: &clusterproviderv1.AzureClusterProviderSpec{}}
+	err := updateScope(
+		controllerfake.NewFakeClient(credentialsSecret),
+		&corev1.SecretReference{Name: "testCredentials", Namespace: "dummyNamespace"},
+		scope)
+	if err != nil {
+		t.Fatalf("Expected workload identity credentials secret to succeed: %v", err)
+	}
+	if scope.Authorizer == nil {
+		t.Errorf("Expected an Authorizer to be set")
+	}
+}
+
+func TestCredentialsSecretFailuresMSI(t *testing.T) {
+	credentialsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testCredentials",
+			Namespace: "dummyNamespace",
+		},
+		Data: map[string][]byte{
+			"azure_resourcegroup":   []byte("dummyResourceGroup"),
+			"azure_region":          []byte("dummyRegion"),
+			"azure_resource_prefix": []byte("dummyClusterName"),
+			"azure_use_msi":         []byte("true"),
+		},
+	}
+
+	if err := testCredentialFields(credentialsSecret); err == nil {
+		t.Errorf("Expected MSI credentials secret missing azure_subscription_id to fail")
+	}
+}
+
+func TestCredentialsSecretFailuresWorkloadIdentity(t *testing.T) {
+	credentialsSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "testCredentials",
+			Namespace: "dummyNamespace",
+		},
+		Data: map[string][]byte{
+			"azure_subscription_id":      []byte("dummySubID"),
+			"azure_resourcegroup":        []byte("dummyResourceGroup"),
+			"azure_region":               []byte("dummyRegion"),
+			"azure_resource_prefix":      []byte("dummyClusterName"),
+			"azure_federated_token_file": []byte("/tmp/does-not-matter"),
+		},
+	}
+
+	if err := testCredentialFields(credentialsSecret); err == nil {
+		t.Errorf("Expected workload identity credentials secret missing azure_client_id to fail")
+	}
+
+	credentialsSecret.Data["azure_client_id"] = []byte("dummyClientID")
+	if err := testCredentialFields(credentialsSecret); err == nil {
+		t.Errorf("Expected workload identity credentials secret missing azure_tenant_id to fail")
+	}
+}
+
 func testCredentialFields(credentialsSecret *corev1.Secret) error {
 	scope := &Scope{Cluster: &clusterv1.Cluster{}, ClusterConfig: &clusterproviderv1.AzureClusterProviderSpec{}}
 	return updateScope(
@@ -134,8 +291,25 @@ func TestCredentialsSecretFailures(t *testing.T) {
 		Data: map[string][]byte{},
 	}
 
-	if err := testCredentialFields(credentialsSecret); err == nil {
-		t.Errorf("Expected New credentials secrets to fail")
+	err := testCredentialFields(credentialsSecret)
+	if err == nil {
+		t.Fatalf("Expected New credentials secrets to fail")
+	}
+	if !errors.Is(err, ErrMissingCredentialField) {
+		t.Errorf("Expected error to wrap ErrMissingCredentialField, got: %v", err)
+	}
+	for _, key := range []string{
+		"azure_subscription_id",
+		"azure_client_id",
+		"azure_client_secret",
+		"azure_tenant_id",
+		"azure_resourcegroup",
+		"azure_region",
+		"azure_resource_prefix",
+	} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Expected aggregated error to mention %q, got: %v", key, err)
+		}
 	}
 
 	credentialsSecret.Data["azure_subscription_id"] = []byte("dummyValue")
@@ -277,6 +451,102 @@ func TestPersistMachineScope(t *testing.T) {
 	}
 }
 
+func TestPersistMachineScopeInstanceStateTransitions(t *testing.T) {
+	machine := testMachine(t)
+	recorder := record.NewFakeRecorder(10)
+
+	params := MachineScopeParams{
+		Machine:       machine,
+		Cluster:       nil,
+		Client:        fake.NewSimpleClientset(machine).MachineV1beta1(),
+		CoreClient:    controllerfake.NewFakeClientWithScheme(scheme.Scheme, testCredentialSecret()),
+		EventRecorder: recorder,
+	}
+
+	scope, err := NewMachineScope(params)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// Discovering an InstanceState for the first time is not a transition:
+	// no Event, but LastInstanceStateTransitionTime is recorded.
+	scope.MachineStatus.InstanceState = pointer.StringPtr(machineproviderv1.InstanceStateCreating)
+	if err := scope.Persist(); err != nil {
+		t.Fatalf("Expected MachineScope.Persist to succeed, got error: %v", err)
+	}
+	if scope.MachineStatus.LastInstanceStateTransitionTime == nil {
+		t.Errorf("Expected LastInstanceStateTransitionTime to be set after discovering InstanceState")
+	}
+	select {
+	case e := <-recorder.Events:
+		t.Errorf("Expected no event when InstanceState is discovered, got: %q", e)
+	default:
+	}
+
+	// A real transition fires an Event and updates the transition time.
+	scope, err = NewMachineScope(params)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	scope.MachineStatus.InstanceState = pointer.StringPtr(machineproviderv1.InstanceStateRunning)
+	if err := scope.Persist(); err != nil {
+		t.Fatalf("Expected MachineScope.Persist to succeed, got error: %v", err)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "InstanceState"+machineproviderv1.InstanceStateRunning) {
+			t.Errorf("Expected event to mention transition to %q, got: %q", machineproviderv1.InstanceStateRunning, e)
+		}
+	default:
+		t.Errorf("Expected an event when InstanceState transitions")
+	}
+	if scope.MachineStatus.LastInstanceStateTransitionTime == nil {
+		t.Fatalf("Expected LastInstanceStateTransitionTime to be set")
+	}
+}
+
+func TestPersistMachineScopeTerminalFailureState(t *testing.T) {
+	machine := testMachine(t)
+
+	params := MachineScopeParams{
+		Machine:    machine,
+		Cluster:    nil,
+		Client:     fake.NewSimpleClientset(machine).MachineV1beta1(),
+		CoreClient: controllerfake.NewFakeClientWithScheme(scheme.Scheme, testCredentialSecret()),
+	}
+
+	scope, err := NewMachineScope(params)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	scope.MachineStatus.InstanceState = pointer.StringPtr(machineproviderv1.InstanceStateFailed)
+	scope.MachineStatus.FailureReason = pointer.StringPtr("InvalidConfiguration")
+	scope.MachineStatus.FailureMessage = pointer.StringPtr("the VM size is not available in this region")
+
+	if err := scope.Persist(); err != nil {
+		t.Fatalf("Expected MachineScope.Persist to succeed, got error: %v", err)
+	}
+	if !scope.IsTerminalFailureState() {
+		t.Errorf("Expected MachineScope.IsTerminalFailureState to be true once InstanceState is Failed")
+	}
+
+	updatedMachine, err := params.Client.Machines(params.Machine.Namespace).Get(params.Machine.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Unable to get updated machine: %v", err)
+	}
+	machineStatus, err := machineproviderv1.MachineStatusFromProviderStatus(updatedMachine.Status.ProviderStatus)
+	if err != nil {
+		t.Fatalf("failed to get machine provider status: %v", err)
+	}
+	if machineStatus.FailureReason == nil || *machineStatus.FailureReason != "InvalidConfiguration" {
+		t.Errorf("Expected FailureReason to persist as %q, got %v", "InvalidConfiguration", machineStatus.FailureReason)
+	}
+	if !machineproviderv1.IsTerminalFailureState(machineStatus) {
+		t.Errorf("Expected persisted status to report a terminal failure state")
+	}
+}
+
 func TestNewMachineScope(t *testing.T) {
 	machineConfigNoValues := &machineproviderv1.AzureMachineProviderSpec{
 		CredentialsSecret: &corev1.SecretReference{Name: "testCredentials", Namespace: "dummyNamespace"},
@@ -321,3 +591,88 @@ func TestNewMachineScope(t *testing.T) {
 		}
 	}
 }
+
+func TestNewMachineScopeConditions(t *testing.T) {
+	type expectedCondition struct {
+		conditionType machineproviderv1.ConditionType
+		status        corev1.ConditionStatus
+		reason        string
+	}
+
+	testCases := []struct {
+		name               string
+		secretData         map[string][]byte
+		expectSuccess      bool
+		expectedConditions []expectedCondition
+	}{
+		{
+			name:          "valid credentials",
+			secretData:    testCredentialSecret().Data,
+			expectSuccess: true,
+			expectedConditions: []expectedCondition{
+				{machineproviderv1.CredentialsSecretValidCondition, corev1.ConditionTrue, machineproviderv1.ReasonValid},
+				{machineproviderv1.AzureAuthorizerReadyCondition, corev1.ConditionTrue, machineproviderv1.ReasonReady},
+				{machineproviderv1.ResourceGroupResolvedCondition, corev1.ConditionTrue, machineproviderv1.ReasonResolved},
+			},
+		},
+		{
+			name:          "missing all required fields",
+			secretData:    map[string][]byte{},
+			expectSuccess: false,
+			expectedConditions: []expectedCondition{
+				{machineproviderv1.CredentialsSecretValidCondition, corev1.ConditionFalse, machineproviderv1.ReasonMissingSubscriptionID},
+				{machineproviderv1.AzureAuthorizerReadyCondition, corev1.ConditionFalse, machineproviderv1.ReasonMissingClientID},
+				// testMachine's provider spec sets location and resource
+				// group, so they resolve without the secret.
+				{machineproviderv1.ResourceGroupResolvedCondition, corev1.ConditionTrue, machineproviderv1.ReasonResolved},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := testMachine(t)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "testCredentials", Namespace: "dummyNamespace"},
+				Data:       tc.secretData,
+			}
+			machineClient := fake.NewSimpleClientset(machine).MachineV1beta1()
+
+			_, err := NewMachineScope(MachineScopeParams{
+				Machine:    machine,
+				Cluster:    nil,
+				Client:     machineClient,
+				CoreClient: controllerfake.NewFakeClientWithScheme(scheme.Scheme, secret),
+			})
+			if tc.expectSuccess && err != nil {
+				t.Fatalf("Expected NewMachineScope to succeed, got error: %v", err)
+			}
+			if !tc.expectSuccess && err == nil {
+				t.Fatalf("Expected NewMachineScope to fail")
+			}
+
+			updatedMachine, err := machineClient.Machines(machine.Namespace).Get(machine.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Unable to get updated machine: %v", err)
+			}
+
+			machineStatus, err := machineproviderv1.MachineStatusFromProviderStatus(updatedMachine.Status.ProviderStatus)
+			if err != nil {
+				t.Fatalf("Unable to decode provider status: %v", err)
+			}
+
+			for _, expected := range tc.expectedConditions {
+				condition := machineproviderv1.FindCondition(machineStatus.Conditions, expected.conditionType)
+				if condition == nil {
+					t.Fatalf("Expected %s condition to be set", expected.conditionType)
+				}
+				if condition.Status != expected.status {
+					t.Errorf("Expected %s status %v, got %v", expected.conditionType, expected.status, condition.Status)
+				}
+				if condition.Reason != expected.reason {
+					t.Errorf("Expected %s reason %v, got %v", expected.conditionType, expected.reason, condition.Reason)
+				}
+			}
+		})
+	}
+}